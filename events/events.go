@@ -0,0 +1,159 @@
+// Package events provides typed Go structs for common Asterisk Manager events and
+// actions, plus reflection-based (Un)marshal helpers that convert between them and
+// the map[string]string headers gami.Message carries. It has no dependency on gami
+// itself so that gami can depend on it without creating an import cycle.
+package events
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Unmarshal, populate the exported fields of v (a pointer to struct) from m, matching
+// AMI header names against each field's `ami:"HeaderName"` tag (or the field name
+// itself when the tag is absent). Supports string, int/int64, bool ("1"/"yes"/"true"
+// are truthy) and time.Duration (seconds) fields.
+func Unmarshal(m map[string]string, v interface{}) error {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("events: Unmarshal expects a pointer to struct, got %T", v)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		header := field.Tag.Get("ami")
+		if header == "" {
+			header = field.Name
+		}
+
+		raw, ok := m[header]
+		if !ok {
+			continue
+		}
+
+		if err := setField(rv.Field(i), raw); err != nil {
+			return fmt.Errorf("events: field %s: %w", field.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Marshal, the inverse of Unmarshal: build a map[string]string header set out of v's
+// exported fields (a struct or a pointer to one), ready to become a gami.Message for
+// an outgoing action
+func Marshal(v interface{}) (map[string]string, error) {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("events: Marshal expects a struct or pointer to struct, got %T", v)
+	}
+	rt := rv.Type()
+
+	out := make(map[string]string)
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		header := field.Tag.Get("ami")
+		if header == "" {
+			header = field.Name
+		}
+
+		raw, ok := fieldString(rv.Field(i))
+		if !ok {
+			continue
+		}
+		out[header] = raw
+	}
+
+	return out, nil
+}
+
+// setField, assign raw into fv, converting to its Go type
+func setField(fv reflect.Value, raw string) error {
+	switch {
+	case fv.Type() == durationType:
+		secs, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(time.Duration(secs) * time.Second))
+
+	case fv.Kind() == reflect.String:
+		fv.SetString(raw)
+
+	case fv.Kind() == reflect.Bool:
+		fv.SetBool(isTruthy(raw))
+
+	case isIntKind(fv.Kind()):
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+
+	default:
+		return fmt.Errorf("unsupported field kind %s", fv.Kind())
+	}
+
+	return nil
+}
+
+// fieldString, render fv back to its AMI wire representation; ok is false for field
+// kinds Marshal doesn't know how to render, which are then left out of the result
+func fieldString(fv reflect.Value) (raw string, ok bool) {
+	switch {
+	case fv.Type() == durationType:
+		return strconv.FormatInt(int64(time.Duration(fv.Int())/time.Second), 10), true
+
+	case fv.Kind() == reflect.String:
+		return fv.String(), true
+
+	case fv.Kind() == reflect.Bool:
+		if fv.Bool() {
+			return "yes", true
+		}
+		return "no", true
+
+	case isIntKind(fv.Kind()):
+		return strconv.FormatInt(fv.Int(), 10), true
+
+	default:
+		return "", false
+	}
+}
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	default:
+		return false
+	}
+}
+
+func isTruthy(raw string) bool {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "1", "yes", "true", "on":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,87 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnmarshal(t *testing.T) {
+	m := map[string]string{
+		"Channel":         "SIP/100-00000001",
+		"Uniqueid":        "1234.5",
+		"CallerIDNum":     "100",
+		"Cause":           "16",
+		"Cause-txt":       "Normal Clearing",
+		"Duration":        "42",
+		"BillableSeconds": "40",
+	}
+
+	var h Hangup
+	if err := Unmarshal(m, &h); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if h.Channel != "SIP/100-00000001" || h.Uniqueid != "1234.5" || h.CallerIDNum != "100" || h.Cause != "16" || h.CauseTxt != "Normal Clearing" {
+		t.Fatalf("Hangup = %+v, want matching fields", h)
+	}
+
+	var cdr Cdr
+	if err := Unmarshal(m, &cdr); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if cdr.Duration != 42*time.Second {
+		t.Errorf("Duration = %v, want 42s", cdr.Duration)
+	}
+	if cdr.BillableSeconds != 40*time.Second {
+		t.Errorf("BillableSeconds = %v, want 40s", cdr.BillableSeconds)
+	}
+}
+
+func TestUnmarshalRejectsNonPointer(t *testing.T) {
+	if err := Unmarshal(map[string]string{}, Hangup{}); err == nil {
+		t.Fatal("Unmarshal with a non-pointer should have returned an error")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	o := Originate{
+		Channel: "SIP/100",
+		Context: "default",
+		Exten:   "100",
+		Timeout: 30000,
+		Async:   true,
+	}
+
+	m, err := Marshal(&o)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if m["Channel"] != "SIP/100" || m["Timeout"] != "30000" || m["Async"] != "yes" {
+		t.Fatalf("m = %+v, want matching headers", m)
+	}
+}
+
+func TestMarshalUnmarshalRoundTrip(t *testing.T) {
+	want := QueueMemberAdded{
+		Queue:          "support",
+		Location:       "SIP/100",
+		MemberName:     "Agent 100",
+		StateInterface: "SIP/100",
+		Membership:     "dynamic",
+		Penalty:        1,
+		CallsTaken:     7,
+		Status:         1,
+	}
+
+	m, err := Marshal(&want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var got QueueMemberAdded
+	if err := Unmarshal(m, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+package events
+
+import "time"
+
+// Newchannel, fired when a new channel is created
+type Newchannel struct {
+	Channel      string `ami:"Channel"`
+	ChannelState string `ami:"ChannelState"`
+	CallerIDNum  string `ami:"CallerIDNum"`
+	CallerIDName string `ami:"CallerIDName"`
+	Uniqueid     string `ami:"Uniqueid"`
+	Context      string `ami:"Context"`
+	Exten        string `ami:"Exten"`
+}
+
+// Hangup, fired when a channel is hung up
+type Hangup struct {
+	Channel     string `ami:"Channel"`
+	Uniqueid    string `ami:"Uniqueid"`
+	CallerIDNum string `ami:"CallerIDNum"`
+	Cause       string `ami:"Cause"`
+	CauseTxt    string `ami:"Cause-txt"`
+}
+
+// Dial, fired on both legs of a dial attempt (DialBegin/DialEnd in newer Asterisk
+// versions report as SubEvent)
+type Dial struct {
+	SubEvent    string `ami:"SubEvent"`
+	Channel     string `ami:"Channel"`
+	Destination string `ami:"Destination"`
+	CallerIDNum string `ami:"CallerIDNum"`
+	Uniqueid    string `ami:"Uniqueid"`
+	DialStatus  string `ami:"DialStatus"`
+}
+
+// Bridge, fired when two channels are bridged or unbridged
+type Bridge struct {
+	Bridgestate string `ami:"Bridgestate"`
+	Bridgetype  string `ami:"Bridgetype"`
+	Channel1    string `ami:"Channel1"`
+	Channel2    string `ami:"Channel2"`
+	Uniqueid1   string `ami:"Uniqueid1"`
+	Uniqueid2   string `ami:"Uniqueid2"`
+}
+
+// VarSet, fired when a channel variable is set
+type VarSet struct {
+	Channel  string `ami:"Channel"`
+	Uniqueid string `ami:"Uniqueid"`
+	Variable string `ami:"Variable"`
+	Value    string `ami:"Value"`
+}
+
+// PeerStatus, fired on SIP/PJSIP peer registration state changes
+type PeerStatus struct {
+	Peer       string `ami:"Peer"`
+	PeerStatus string `ami:"PeerStatus"`
+	Address    string `ami:"Address"`
+}
+
+// QueueMemberAdded, fired when a member is added to a queue
+type QueueMemberAdded struct {
+	Queue          string `ami:"Queue"`
+	Location       string `ami:"Location"`
+	MemberName     string `ami:"MemberName"`
+	StateInterface string `ami:"StateInterface"`
+	Membership     string `ami:"Membership"`
+	Penalty        int    `ami:"Penalty"`
+	CallsTaken     int    `ami:"CallsTaken"`
+	Status         int    `ami:"Status"`
+}
+
+// QueueMemberRemoved, fired when a member is removed from a queue
+type QueueMemberRemoved struct {
+	Queue      string `ami:"Queue"`
+	Location   string `ami:"Location"`
+	MemberName string `ami:"MemberName"`
+}
+
+// Cdr, a call detail record
+type Cdr struct {
+	AccountCode     string        `ami:"AccountCode"`
+	Source          string        `ami:"Source"`
+	Destination     string        `ami:"Destination"`
+	Channel         string        `ami:"Channel"`
+	Duration        time.Duration `ami:"Duration"`
+	BillableSeconds time.Duration `ami:"BillableSeconds"`
+	Disposition     string        `ami:"Disposition"`
+	Uniqueid        string        `ami:"Uniqueid"`
+}
+
+// Originate, parameters for the Originate action
+type Originate struct {
+	Channel     string `ami:"Channel"`
+	Context     string `ami:"Context"`
+	Exten       string `ami:"Exten"`
+	Priority    string `ami:"Priority"`
+	Application string `ami:"Application"`
+	Data        string `ami:"Data"`
+	Timeout     int    `ami:"Timeout"`
+	CallerID    string `ami:"CallerID"`
+	Account     string `ami:"Account"`
+	Async       bool   `ami:"Async"`
+}
+
+// Redirect, parameters for the Redirect action
+type Redirect struct {
+	Channel      string `ami:"Channel"`
+	ExtraChannel string `ami:"ExtraChannel"`
+	Context      string `ami:"Context"`
+	Exten        string `ami:"Exten"`
+	Priority     string `ami:"Priority"`
+}
+
+// SIPpeers, parameters for the SIPpeers action (a multi-message response, one
+// PeerEntry event per peer followed by a PeerlistComplete)
+type SIPpeers struct{}
+
+// QueueStatus, parameters for the QueueStatus action
+type QueueStatus struct {
+	Queue  string `ami:"Queue"`
+	Member string `ami:"Member"`
+}
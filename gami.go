@@ -1,14 +1,22 @@
 package gami
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
-	"net"
+	"math/rand"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"sync"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
 )
 
 const (
@@ -18,12 +26,39 @@ const (
 	_CMD_END      = "--END COMMAND--" // Asterisk command data end
 	_HOST         = "gami"            // default host value
 	ORIG_TMOUT    = 30000             // Originate timeout
+	_TRACE_HEADER = "X-Trace-Id"      // header carrying an inbound trace context on events
+	_JANITOR_TICK = time.Second       // how often the janitor sweeps for expired callbacks
+
+	_DISCONNECTED_TAG = "X-Gami-Disconnected" // synthetic header marking a message as an ErrDisconnected stand-in
+
+	_EVT_RECONNECTED  = "gami.Reconnected"  // synthetic Event dispatched through defaultHandler after a successful reconnect
+	_EVT_DISCONNECTED = "gami.Disconnected" // synthetic Event dispatched through defaultHandler when the connection drops
 )
 
+// ErrDisconnected, returned by Do for non-idempotent actions that were still pending
+// when the connection dropped with a ReconnectPolicy set, and by Do/DoMulti once
+// reconnect has given up for good
+var ErrDisconnected = errors.New("gami: disconnected")
+
 var (
 	_PT_BYTES = []byte(_LINE_TERM + _LINE_TERM) // packet separator
 )
 
+// jitterRand, a locally-seeded source for ReconnectPolicy's backoff jitter; a
+// *rand.Rand isn't safe for concurrent use on its own, so access is serialized by
+// jitterMu
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// jitter, a random int64 in [0, n)
+func jitter(n int64) int64 {
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return jitterRand.Int63n(n)
+}
+
 // basic Asterisk message
 type Message map[string]string
 
@@ -74,35 +109,105 @@ func (a *Aid) Generate() string {
 
 // callback function storage
 type cbList struct {
-	mu *sync.RWMutex
-	f  map[string]*func(Message)
-	sd map[string]bool // callback will self delete (used for multi-message responses)
+	mu         *sync.RWMutex
+	f          map[string]*func(Message)
+	sd         map[string]bool             // callback will self delete (used for multi-message responses)
+	span       map[string]opentracing.Span // in-flight span covering this action id, if tracing is enabled
+	deadline   map[string]time.Time        // when set (non-zero), the janitor expires the callback past this time
+	msg        map[string]Message          // the outgoing message this callback is waiting on, kept for reconnect replay
+	idempotent map[string]bool             // replay the outgoing message on reconnect instead of failing with ErrDisconnected
+}
+
+// pendingEntry, a snapshot of one cbList row, returned by drain
+type pendingEntry struct {
+	key        string
+	f          *func(Message)
+	span       opentracing.Span
+	msg        Message
+	idempotent bool
 }
 
 // set, setting handle function for specific action id|event (will overwrite current if present)
-func (cbl *cbList) set(key string, f *func(Message), sd bool) {
+func (cbl *cbList) set(key string, f *func(Message), sd bool, span opentracing.Span, deadline time.Time, msg Message, idempotent bool) {
 
 	cbl.mu.Lock()
 	defer cbl.mu.Unlock()
 	cbl.f[key] = f
 	cbl.sd[key] = sd
+	cbl.span[key] = span
+	cbl.deadline[key] = deadline
+	cbl.msg[key] = msg
+	cbl.idempotent[key] = idempotent
 }
 
-// del, deleting callback for specific action id|event
-func (cbl *cbList) del(key string) {
+// del, deleting callback for specific action id|event; found reports whether there
+// was still an entry to remove, so a caller racing the janitor's expire() (or another
+// del of the same key) can tell whether it actually won and so owns finishing the span
+func (cbl *cbList) del(key string) (found bool) {
 
 	cbl.mu.Lock()
 	defer cbl.mu.Unlock()
+	_, found = cbl.f[key]
 	delete(cbl.f, key)
 	delete(cbl.sd, key)
+	delete(cbl.span, key)
+	delete(cbl.deadline, key)
+	delete(cbl.msg, key)
+	delete(cbl.idempotent, key)
+	return found
 }
 
-// get, returns function for specific action id/event
-func (cbl *cbList) get(key string) (*func(Message), bool) {
+// get, returns function, self-delete flag and in-flight span for specific action id/event
+func (cbl *cbList) get(key string) (*func(Message), bool, opentracing.Span) {
 
 	cbl.mu.RLock()
 	defer cbl.mu.RUnlock()
-	return cbl.f[key], cbl.sd[key]
+	return cbl.f[key], cbl.sd[key], cbl.span[key]
+}
+
+// expire, delete and finish (as timed out) every callback whose deadline has passed
+func (cbl *cbList) expire(now time.Time) {
+
+	cbl.mu.Lock()
+	defer cbl.mu.Unlock()
+	for key, deadline := range cbl.deadline {
+		if deadline.IsZero() || deadline.After(now) {
+			continue
+		}
+		if span := cbl.span[key]; span != nil {
+			span.SetTag("error", true)
+			span.LogKV("message", "janitor: callback expired")
+			span.Finish()
+		}
+		delete(cbl.f, key)
+		delete(cbl.sd, key)
+		delete(cbl.span, key)
+		delete(cbl.deadline, key)
+		delete(cbl.msg, key)
+		delete(cbl.idempotent, key)
+	}
+}
+
+// drain, atomically remove every pending callback and return a snapshot of them,
+// used when the connection drops to fail or replay whatever was in flight
+func (cbl *cbList) drain() []pendingEntry {
+
+	cbl.mu.Lock()
+	defer cbl.mu.Unlock()
+
+	out := make([]pendingEntry, 0, len(cbl.f))
+	for key, f := range cbl.f {
+		out = append(out, pendingEntry{key, f, cbl.span[key], cbl.msg[key], cbl.idempotent[key]})
+	}
+
+	cbl.f = make(map[string]*func(Message))
+	cbl.sd = make(map[string]bool)
+	cbl.span = make(map[string]opentracing.Span)
+	cbl.deadline = make(map[string]time.Time)
+	cbl.msg = make(map[string]Message)
+	cbl.idempotent = make(map[string]bool)
+
+	return out
 }
 
 // Originate, struct used in Originate command
@@ -147,149 +252,702 @@ func NewOriginateApp(channel, app, data string) *Originate {
 
 // main working entity
 type Asterisk struct {
-	address        string         // string adress to host
-	login          string         // login for AMI
-	password       string         // password for AMI
-	conn           *net.TCPConn   // network connection to Asterisk
-	actionHandlers *cbList        // action response handle functions
-	eventHandlers  *cbList        // event handle functions
-	defaultHandler *func(Message) // default handler for all Asterisk messages, useful for debugging
-	netErrHandler  *func(error)   // network error handle function
-	aid            *Aid           // action id
-	authorized     bool           // is successful logined to AMI
-}
-
-// NewAsterisk, Asterisk factory
+	address          string                    // string adress to host
+	login            string                    // login for AMI
+	password         string                    // password for AMI
+	transport        Transport                 // wire-level carrier currently in use, built by transportFactory on Connect
+	transportFactory func() (Transport, error) // builds the Transport a Connect call dials
+	actionHandlers   *cbList                   // action response handle functions
+	eventHandlers    *cbList                   // event handle functions
+	defaultHandler   *func(Message)            // default handler for all Asterisk messages, useful for debugging
+	netErrHandler    *func(error)              // network error handle function
+	aid              *Aid                      // action id
+	authorized       bool                      // is successful logined to AMI
+
+	tracer      opentracing.Tracer // tracer used to open spans around actions/events, nil disables tracing
+	spanHost    string             // host tag attached to every span
+	serviceName string             // service name tag attached to every span
+
+	connMu          sync.Mutex       // guards ready and readyCh
+	ready           bool             // true once the transport is connected; send waits on readyCh while false
+	readyCh         chan struct{}    // closed whenever ready flips to true, replaced when it flips back to false
+	reconnectPolicy *ReconnectPolicy // nil disables automatic reconnect
+	janitorOnce     sync.Once        // the janitor runs for the life of the Asterisk, not restarted on every reconnect
+	closedCh        chan struct{}    // closed once reconnect gives up for good; send() then fails instead of blocking forever
+	reconnecting    int32            // 1 while a reconnect loop is in flight; CAS'd so only one ever runs at a time
+
+	replayMu    sync.Mutex     // guards replayQueue
+	replayQueue []pendingEntry // idempotent actions queued by failOrReplayPending for replayPending
+}
+
+// NewAsterisk, Asterisk factory; connects over plain TCP ("ami://")
 func NewAsterisk(address, login, password string) *Asterisk {
-	return &Asterisk{
-		address:  address,
-		login:    login,
-		password: password,
+	return newAsterisk(address, login, password, func() (Transport, error) {
+		return newTCPTransport(address)
+	})
+}
+
+// NewAsteriskTLS, Asterisk factory; connects over TLS ("amis://") using cfg
+func NewAsteriskTLS(address, login, password string, cfg *tls.Config) *Asterisk {
+	return newAsterisk(address, login, password, func() (Transport, error) {
+		return newTLSTransport(address, cfg)
+	})
+}
+
+// NewAsteriskURL, Asterisk factory that picks a Transport from rawURL's scheme:
+// "ami" for plain TCP, "amis" for TLS, "http"/"https" for the mansession /rawman
+// interface (plain or TLS)
+func NewAsteriskURL(rawURL, login, password string) (*Asterisk, error) {
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "ami":
+		return NewAsterisk(u.Host, login, password), nil
+	case "amis":
+		return NewAsteriskTLS(u.Host, login, password, &tls.Config{}), nil
+	case "http", "https":
+		return newAsterisk(rawURL, login, password, func() (Transport, error) {
+			return newHTTPTransport(rawURL)
+		}), nil
+	default:
+		return nil, fmt.Errorf("gami: unsupported scheme %q", u.Scheme)
+	}
+}
+
+// SetTransportFactory, override how Connect builds its Transport; useful for
+// transports this package doesn't ship, such as a test double
+func (a *Asterisk) SetTransportFactory(f func() (Transport, error)) {
+	a.transportFactory = f
+}
+
+// newAsterisk, shared Asterisk construction for every exported constructor
+func newAsterisk(address, login, password string, tf func() (Transport, error)) *Asterisk {
+	a := &Asterisk{
+		address:          address,
+		login:            login,
+		password:         password,
+		transportFactory: tf,
 		actionHandlers: &cbList{
 			&sync.RWMutex{},
 			make(map[string]*func(Message)),
 			make(map[string]bool),
+			make(map[string]opentracing.Span),
+			make(map[string]time.Time),
+			make(map[string]Message),
+			make(map[string]bool),
 		},
 		eventHandlers: &cbList{
 			&sync.RWMutex{},
 			make(map[string]*func(Message)),
 			make(map[string]bool),
+			make(map[string]opentracing.Span),
+			make(map[string]time.Time),
+			make(map[string]Message),
+			make(map[string]bool),
 		},
 		aid: NewAid(),
 	}
+	a.readyCh = make(chan struct{})
+	a.closedCh = make(chan struct{})
+	return a
 }
 
-// send, send Message to socket
-func (a *Asterisk) send(m Message) error {
+// ReconnectPolicy, governs automatic reconnection after a network error: attempts
+// are spaced by an exponential backoff (BaseDelay doubled every attempt, capped at
+// MaxDelay) with full jitter applied
+type ReconnectPolicy struct {
+	MaxAttempts int           // 0 means retry forever
+	BaseDelay   time.Duration // backoff before the first retry
+	MaxDelay    time.Duration // backoff cap; 0 means uncapped
+}
 
-	buf := bytes.NewBufferString("")
+// NewReconnectPolicy, ReconnectPolicy default values constructor: unlimited
+// attempts, starting at 500ms and capping at 30s
+func NewReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{
+		BaseDelay: 500 * time.Millisecond,
+		MaxDelay:  30 * time.Second,
+	}
+}
 
-	for k, v := range m {
-		buf.Write([]byte(k))
-		buf.Write([]byte(_KEY_VAL_TERM))
-		buf.Write([]byte(v))
-		buf.Write([]byte(_LINE_TERM))
+// backoff, exponential delay for attempt (0-based) with full jitter
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 0; i < attempt && (p.MaxDelay == 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
 	}
-	buf.Write([]byte(_LINE_TERM))
+	return time.Duration(jitter(int64(d) + 1))
+}
+
+// SetReconnectPolicy, enable automatic reconnect and re-login after a network error;
+// passing nil (the default) disables it, restoring the previous "caller rebuilds
+// everything" behavior
+func (a *Asterisk) SetReconnectPolicy(p *ReconnectPolicy) {
+	a.reconnectPolicy = p
+}
+
+// setReady, flip the connection-ready flag send() gates on; going ready closes
+// readyCh, waking up every blocked caller, while going not-ready swaps in a
+// fresh (open) channel for the next wait
+func (a *Asterisk) setReady(ready bool) {
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+	if ready == a.ready {
+		return
+	}
+	a.ready = ready
+	if ready {
+		close(a.readyCh)
+	} else {
+		a.readyCh = make(chan struct{})
+	}
+}
+
+// emitSynthetic, dispatch a synthetic gami.* Event through the default handler so
+// applications can observe connection state transitions
+func (a *Asterisk) emitSynthetic(event string) {
+	if a.defaultHandler != nil {
+		go (*a.defaultHandler)(Message{"Event": event})
+	}
+}
+
+// failOrReplayPending, called when the connection drops: every action still pending
+// in actionHandlers is either queued for replay (if it was sent with Idempotent())
+// or failed immediately with ErrDisconnected
+func (a *Asterisk) failOrReplayPending() {
+	var replay []pendingEntry
+
+	for _, p := range a.actionHandlers.drain() {
+		if p.span != nil {
+			p.span.SetTag("error", true)
+			p.span.LogKV("message", ErrDisconnected.Error())
+		}
 
-	if wrb, err := (*a.conn).Write(buf.Bytes()); wrb != buf.Len() || err != nil {
+		if p.idempotent {
+			replay = append(replay, p)
+			continue
+		}
+
+		if p.span != nil {
+			p.span.Finish()
+		}
+		go (*p.f)(Message{"Response": "Error", "Message": ErrDisconnected.Error(), _DISCONNECTED_TAG: "1"})
+	}
+
+	a.replayMu.Lock()
+	a.replayQueue = append(a.replayQueue, replay...)
+	a.replayMu.Unlock()
+}
+
+// replayPending, re-send every action queued by failOrReplayPending; called once the
+// connection and AMI session have been restored
+func (a *Asterisk) replayPending(ctx context.Context) {
+	a.replayMu.Lock()
+	queue := a.replayQueue
+	a.replayQueue = nil
+	a.replayMu.Unlock()
+
+	for _, p := range queue {
+		a.actionHandlers.set(p.key, p.f, false, p.span, time.Time{}, p.msg, true)
+		if err := a.send(ctx, p.msg, false); err != nil {
+			a.actionHandlers.del(p.key)
+			if p.span != nil {
+				p.span.SetTag("error", true)
+				p.span.LogKV("message", err.Error())
+				p.span.Finish()
+			}
+			go (*p.f)(Message{"Response": "Error", "Message": err.Error(), _DISCONNECTED_TAG: "1"})
+		}
+	}
+}
+
+// failReplayQueue, fail every action queued for replay with ErrDisconnected instead of
+// replaying it; called when reconnect gives up for good, since nothing will ever come
+// along to replay these
+func (a *Asterisk) failReplayQueue() {
+	a.replayMu.Lock()
+	queue := a.replayQueue
+	a.replayQueue = nil
+	a.replayMu.Unlock()
+
+	for _, p := range queue {
+		if p.span != nil {
+			p.span.SetTag("error", true)
+			p.span.LogKV("message", ErrDisconnected.Error())
+			p.span.Finish()
+		}
+		go (*p.f)(Message{"Response": "Error", "Message": ErrDisconnected.Error(), _DISCONNECTED_TAG: "1"})
+	}
+}
+
+// reconnect, dial address and re-login with exponential backoff until it succeeds or
+// reconnectPolicy.MaxAttempts is exhausted; eventHandlers is untouched by a reconnect
+// since it lives on Asterisk itself rather than on the dropped connection. ready is
+// deliberately left false until login succeeds, so callers queued up in send() can't
+// fire actions against a freshly-dialed but not-yet-authenticated session; the reconnect
+// login itself bypasses that gate since it's the one thing allowed to use the connection
+// first.
+//
+// Only one reconnect loop ever runs at a time: readDispatcher fires one unconditionally
+// on every read error, including one from the freshly-dialed session connect() starts
+// mid-reconnect, so without this guard a dropped re-login window would spawn a second
+// loop racing the first to dial/login/setReady.
+func (a *Asterisk) reconnect(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&a.reconnecting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&a.reconnecting, 0)
+
+	policy := a.reconnectPolicy
+
+	for attempt := 0; policy.MaxAttempts == 0 || attempt < policy.MaxAttempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(policy.backoff(attempt)):
+		}
+
+		if err := a.connect(ctx); err != nil {
+			if a.netErrHandler != nil {
+				(*a.netErrHandler)(err)
+			}
+			continue
+		}
+
+		resp, err := a.doLogin(ctx, bypassReady())
+		if err == nil && resp["Response"] != "Success" {
+			err = fmt.Errorf("gami: reconnect login rejected: %s", resp["Message"])
+		}
 		if err != nil {
-			return err
+			if a.netErrHandler != nil {
+				(*a.netErrHandler)(err)
+			}
+			continue
 		}
-		return fmt.Errorf("Not fully writed packet to output stream\n")
+
+		a.setReady(true)
+		a.replayPending(ctx)
+		a.emitSynthetic(_EVT_RECONNECTED)
+		return
 	}
 
-	return nil
+	log.Println("gami: giving up reconnecting to", a.address)
+	a.failReplayQueue()
+	a.closeTerminal()
 }
 
-func (a *Asterisk) read(pbuf *bytes.Buffer, buf *[]byte) error {
-	rc, err := (*a.conn).Read(*buf)
-	if err != nil { // network error
-		return err
+// SetTracer, plug in an opentracing.Tracer (Zipkin, Jaeger, a mocktracer, or a no-op);
+// leaving it unset (the default) disables tracing entirely
+func (a *Asterisk) SetTracer(t opentracing.Tracer) {
+	a.tracer = t
+}
+
+// SetSpanHost, set the host/service-name pair attached as tags to every span this
+// Asterisk opens
+func (a *Asterisk) SetSpanHost(host, service string) {
+	a.spanHost = host
+	a.serviceName = service
+}
+
+// startActionSpan, open a span covering an action round trip if tracing is enabled
+func (a *Asterisk) startActionSpan(m Message) opentracing.Span {
+	if a.tracer == nil {
+		return nil
 	}
+	span := a.tracer.StartSpan("ami.action")
+	span.SetTag("Action", m["Action"])
+	span.SetTag("ActionID", m["ActionID"])
+	span.SetTag("peer.hostname", a.spanHost)
+	span.SetTag("peer.service", a.serviceName)
+	return span
+}
 
-	wb, err := pbuf.Write((*buf)[:rc])
+// finishActionSpan, tag an in-flight action span with its response and finish it
+func finishActionSpan(span opentracing.Span, m Message) {
+	if span == nil {
+		return
+	}
+	span.SetTag("Response", m["Response"])
+	if m["Response"] == "Error" {
+		span.SetTag("error", true)
+		span.LogKV("message", m["Message"])
+	}
+	span.Finish()
+}
 
-	if err != nil || wb != rc { // can't write to data buffer, just skip
+// startEventSpan, open a span for a dispatched event; if the event carries a
+// _TRACE_HEADER header, the span follows from the context encoded in it, otherwise
+// it starts a new trace
+func (a *Asterisk) startEventSpan(event string, m Message) opentracing.Span {
+	if a.tracer == nil {
 		return nil
 	}
 
-	// while has end of packet symbols in buffer
-	initial := bytes.Index(pbuf.Bytes(), _PT_BYTES)
-	for pos := initial; pos != -1; pos = bytes.Index(pbuf.Bytes(), _PT_BYTES) {
-		bp := make([]byte, pos+len(_PT_BYTES))
-		r, err := pbuf.Read(bp)                    // reading packet to separate puffer
-		if err != nil || r != pos+len(_PT_BYTES) { // reading problems, just skip
-			continue
+	opts := []opentracing.StartSpanOption{}
+	if tid, ok := m[_TRACE_HEADER]; ok {
+		carrier := opentracing.TextMapCarrier{_TRACE_HEADER: tid}
+		if sc, err := a.tracer.Extract(opentracing.TextMap, carrier); err == nil {
+			opts = append(opts, opentracing.FollowsFrom(sc))
+		}
+	}
+
+	span := a.tracer.StartSpan("ami.event", opts...)
+	span.SetTag("Event", event)
+	span.SetTag("peer.hostname", a.spanHost)
+	span.SetTag("peer.service", a.serviceName)
+	return span
+}
+
+// DoOption, configures a single Do/DoMulti call
+type DoOption func(*doConfig)
+
+type doConfig struct {
+	idempotent  bool
+	bypassReady bool
+}
+
+// Idempotent marks an action as safe to replay verbatim after a reconnect. Pending
+// idempotent actions are resent once the session is restored instead of being
+// failed with ErrDisconnected when the connection drops while they are in flight.
+func Idempotent() DoOption {
+	return func(c *doConfig) { c.idempotent = true }
+}
+
+// bypassReady, skip waiting on the ready gate; used only by the reconnect loop to log
+// back in, since during that window ready is deliberately still false and nothing else
+// can be queued up in send() yet to race against it
+func bypassReady() DoOption {
+	return func(c *doConfig) { c.bypassReady = true }
+}
+
+// Do, send an Action message and block for the matching response, honoring ctx: if
+// ctx is cancelled or its deadline expires before a response arrives, the pending
+// callback is removed from actionHandlers (any late response is silently dropped)
+// and ctx.Err() is returned. Generates an ActionID when the message doesn't carry
+// one, and, when a Tracer is set, opens a span covering the round trip from request
+// write to matching response callback (or to cancellation). If a ReconnectPolicy is
+// set and the connection drops while the action is pending, Do returns
+// ErrDisconnected unless it was sent with Idempotent(), in which case it is replayed
+// once the connection is restored; without a ReconnectPolicy the pending action is
+// left in place and Do waits on ctx.
+func (a *Asterisk) Do(ctx context.Context, m Message, opts ...DoOption) (Message, error) {
+
+	cfg := &doConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if m["ActionID"] == "" {
+		m["ActionID"] = a.aid.Generate()
+	}
+
+	span := a.startActionSpan(m)
+	deadline, _ := ctx.Deadline()
+
+	respChann := make(chan Message, 1)
+	cb := func(resp Message) { respChann <- resp }
+	a.actionHandlers.set(m["ActionID"], &cb, false, span, deadline, m, cfg.idempotent)
+
+	if err := a.send(ctx, m, cfg.bypassReady); err != nil {
+		if a.actionHandlers.del(m["ActionID"]) && span != nil {
+			span.SetTag("error", true)
+			span.LogKV("message", err.Error())
+			span.Finish()
 		}
+		return nil, err
+	}
 
-		m := make(Message)
+	select {
+	case resp := <-respChann:
+		if resp[_DISCONNECTED_TAG] != "" {
+			return nil, ErrDisconnected
+		}
+		return resp, nil
+	case <-ctx.Done():
+		// del only finishes the span if it actually won the race against the janitor
+		// expiring this same key first; otherwise the janitor already finished it
+		if a.actionHandlers.del(m["ActionID"]) && span != nil {
+			span.SetTag("error", true)
+			span.LogKV("message", ctx.Err().Error())
+			span.Finish()
+		}
+		return nil, ctx.Err()
+	}
+}
 
-		// splitting packet by line separator
-		for _, line := range bytes.Split(bp, []byte(_LINE_TERM)) {
-			// empty line
-			if len(line) == 0 {
-				continue
+// DoMulti, send an Action message whose response spans several messages (e.g.
+// SIPpeers, QueueStatus) and stream every matching message back on the returned
+// channel until ctx is done, at which point the callback is removed and the
+// channel is closed. As with Do, with a ReconnectPolicy set a dropped connection
+// fails the action with a _DISCONNECTED_TAG-tagged Message unless it was sent with
+// Idempotent().
+func (a *Asterisk) DoMulti(ctx context.Context, m Message, opts ...DoOption) (<-chan Message, error) {
+
+	cfg := &doConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if m["ActionID"] == "" {
+		m["ActionID"] = a.aid.Generate()
+	}
+
+	span := a.startActionSpan(m)
+	deadline, _ := ctx.Deadline()
+
+	out := make(chan Message, 16)
+	cb := func(resp Message) {
+		select {
+		case out <- resp:
+		case <-ctx.Done():
+		}
+	}
+	a.actionHandlers.set(m["ActionID"], &cb, true, span, deadline, m, cfg.idempotent) // sd: torn down by ctx, not by the first response
+
+	if err := a.send(ctx, m, cfg.bypassReady); err != nil {
+		found := a.actionHandlers.del(m["ActionID"])
+		close(out)
+		if found && span != nil {
+			span.SetTag("error", true)
+			span.LogKV("message", err.Error())
+			span.Finish()
+		}
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		// del only finishes the span if it actually won the race against the janitor
+		// expiring this same key first
+		if a.actionHandlers.del(m["ActionID"]) && span != nil {
+			span.Finish()
+		}
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// janitor, periodically expires actionHandlers callbacks whose deadline has passed;
+// a safety net for Do/DoMulti callers whose own ctx.Done() watcher never runs
+func (a *Asterisk) janitor(ctx context.Context) {
+
+	ticker := time.NewTicker(_JANITOR_TICK)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.actionHandlers.expire(now)
+		}
+	}
+}
+
+// SendAction, send an Action message and block for the matching response; kept for
+// back-compat and implemented on top of Do with a context that never expires
+func (a *Asterisk) SendAction(m Message) (Message, error) {
+	return a.Do(context.Background(), m)
+}
+
+// Login, authenticate against AMI using the credentials this Asterisk was created with
+func (a *Asterisk) Login() (Message, error) {
+	return a.doLogin(context.Background())
+}
+
+// doLogin, shared Login implementation; opts lets the reconnect loop bypass the ready
+// gate so it can log back in before flipping ready true for everyone else
+func (a *Asterisk) doLogin(ctx context.Context, opts ...DoOption) (Message, error) {
+	resp, err := a.Do(ctx, Message{
+		"Action":   "Login",
+		"Username": a.login,
+		"Secret":   a.password,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	a.authorized = resp["Response"] == "Success"
+	return resp, nil
+}
+
+// Originate, run the Originate action described by o and block for the response
+func (a *Asterisk) Originate(o *Originate) (Message, error) {
+
+	m := Message{
+		"Action":   "Originate",
+		"Channel":  o.Channel,
+		"Timeout":  strconv.Itoa(o.Timeout),
+		"CallerID": o.CallerID,
+		"Account":  o.Account,
+		"Async":    strconv.FormatBool(o.Async),
+	}
+
+	if o.Application != "" {
+		m["Application"] = o.Application
+		m["Data"] = o.Data
+	} else {
+		m["Context"] = o.Context
+		m["Exten"] = o.Exten
+		m["Priority"] = o.Priority
+	}
+
+	return a.SendAction(m)
+}
+
+// send, write Message through the current Transport; waits on the connection-ready
+// signal so callers queue up instead of racing the transport while a reconnect is in
+// progress, but gives up and returns ctx.Err() if ctx is done first, or ErrDisconnected
+// if reconnect has permanently given up in the meantime. bypassReady skips the wait
+// entirely, for the reconnect loop's own login which must run before ready flips true.
+func (a *Asterisk) send(ctx context.Context, m Message, bypassReady bool) error {
+
+	if !bypassReady {
+		for {
+			select {
+			case <-a.closedCh:
+				return ErrDisconnected
+			default:
 			}
-			kvl := bytes.SplitN(line, []byte(_KEY_VAL_TERM), 2)
 
-			// not standard header
-			if len(kvl) == 1 {
-				if string(line) != _CMD_END {
-					m["CmdData"] += string(line)
-				}
-				continue
+			a.connMu.Lock()
+			ready, readyCh := a.ready, a.readyCh
+			a.connMu.Unlock()
+			if ready {
+				break
 			}
 
-			k := bytes.TrimSpace(kvl[0])
-			v := bytes.TrimSpace(kvl[1])
-			m[string(k)] = string(v)
-		}
-		// if has ActionID and has callback run it and delete
-		if v, vok := m["ActionID"]; vok {
-			if f, sd := a.actionHandlers.get(v); f != nil {
-				go (*f)(m)
-				if !sd { // will never remove "self-delete" callbacks
-					a.actionHandlers.del(v)
-				}
+			select {
+			case <-readyCh:
+			case <-a.closedCh:
+				return ErrDisconnected
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
+	}
 
-		// if Event and has callback run it
-		if v, vok := m["Event"]; vok {
-			if f, _ := a.eventHandlers.get(v); f != nil {
+	return a.transport.WritePacket(m)
+}
+
+// closeTerminal, mark this Asterisk as permanently disconnected: every send() call,
+// past or future, fails immediately with ErrDisconnected instead of waiting for a
+// reconnect that is never coming
+func (a *Asterisk) closeTerminal() {
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+	select {
+	case <-a.closedCh:
+	default:
+		close(a.closedCh)
+	}
+}
+
+// dispatch, run the action/event/default handlers matching one already-parsed Message
+func (a *Asterisk) dispatch(m Message) {
+
+	// if has ActionID and has callback run it and delete
+	if v, vok := m["ActionID"]; vok {
+		if f, sd, span := a.actionHandlers.get(v); f != nil {
+			if sd {
+				// self-delete callbacks (DoMulti) own their span's lifetime via their
+				// own ctx.Done() teardown, so each streamed message only runs f, it
+				// never finishes the span itself
 				go (*f)(m)
+			} else if a.actionHandlers.del(v) { // del wins the race against the janitor expiring this key first
+				go func() {
+					finishActionSpan(span, m)
+					(*f)(m)
+				}()
 			}
 		}
+	}
 
-		// run default handler if not nil
-		if a.defaultHandler != nil {
-			go (*a.defaultHandler)(m)
+	// every dispatched event gets a span, following the trace context carried in
+	// the event (if any) when tracing is enabled, whether or not a handler is
+	// registered for it
+	if v, vok := m["Event"]; vok {
+		span := a.startEventSpan(v, m)
+		if f, _, _ := a.eventHandlers.get(v); f != nil {
+			go func() {
+				if span != nil {
+					defer span.Finish()
+				}
+				(*f)(m)
+			}()
+		} else if span != nil {
+			span.Finish()
 		}
 	}
-	buf = nil
-	return nil
+
+	// run default handler if not nil
+	if a.defaultHandler != nil {
+		go (*a.defaultHandler)(m)
+	}
 }
 
-// readDispatcher, reads data from socket and builds messages
-func (a *Asterisk) readDispatcher(finishChann <-chan struct{}) {
-	pbuf := bytes.NewBufferString("") // data buffer
-	buf := make([]byte, _READ_BUF)    // read buffer
+// readDispatcher, reads packets off the Transport and dispatches them until ctx is
+// done or a network error occurs
+func (a *Asterisk) readDispatcher(ctx context.Context) {
 	for {
 		select {
-		case <-finishChann:
+		case <-ctx.Done():
 			log.Println("Finalizing ami read events")
-			a.conn.Close()
+			a.transport.Close()
 			return
 		default:
-			if err := a.read(pbuf, &buf); err != nil {
-				log.Println("Error reading from socket:", err)
-				a.authorized = false        // unauth
+			m, err := a.transport.ReadPacket()
+			if err != nil {
+				log.Println("Error reading from transport:", err)
+				a.authorized = false // unauth
+				a.setReady(false)
 				if a.netErrHandler != nil { // run network error callback
 					(*a.netErrHandler)(err)
 				}
+				if a.reconnectPolicy != nil {
+					a.emitSynthetic(_EVT_DISCONNECTED)
+					a.failOrReplayPending()
+					go a.reconnect(ctx)
+				}
 				return
 			}
+			a.dispatch(m)
 		}
 	}
 }
+
+// connect, build a Transport via transportFactory and start the read dispatcher (and,
+// the first time only, the janitor); both stop when ctx is done, unifying shutdown of
+// the connection with cancellation of any Do/DoMulti calls sharing the same ctx. Unlike
+// Connect, it does not flip ready, so the caller gets a window to authenticate first.
+func (a *Asterisk) connect(ctx context.Context) error {
+
+	t, err := a.transportFactory()
+	if err != nil {
+		return err
+	}
+	a.transport = t
+
+	go a.readDispatcher(ctx)
+	a.janitorOnce.Do(func() { go a.janitor(ctx) })
+
+	return nil
+}
+
+// Connect, build a Transport and mark the connection ready for use. Used for the
+// initial connection, where the caller is expected to call Login next; reconnect uses
+// the lower-level connect instead, so it can log back in before flipping ready.
+func (a *Asterisk) Connect(ctx context.Context) error {
+	if err := a.connect(ctx); err != nil {
+		return err
+	}
+	a.setReady(true)
+	return nil
+}
@@ -0,0 +1,28 @@
+package gami
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/warik/gami/events"
+)
+
+// OnEvent, register f against the Event named after T (e.g. events.Hangup -> the
+// "Hangup" Event) with typed, unmarshalled fields instead of a raw Message; wires
+// through the same eventHandlers table plain event callbacks use, so it shares
+// tracing and dispatch behaviour with them
+func OnEvent[T any](a *Asterisk, f func(T)) {
+
+	var zero T
+	t := reflect.TypeOf(zero)
+
+	cb := func(m Message) {
+		v := reflect.New(t)
+		if err := events.Unmarshal(m, v.Interface()); err != nil {
+			return
+		}
+		f(v.Elem().Interface().(T))
+	}
+
+	a.eventHandlers.set(t.Name(), &cb, false, nil, time.Time{}, nil, false)
+}
@@ -0,0 +1,33 @@
+package gami
+
+import (
+	"testing"
+	"time"
+
+	"github.com/warik/gami/events"
+)
+
+func TestOnEventDispatchesUnmarshalledEvent(t *testing.T) {
+	a := newAsterisk("test", "user", "pass", nil)
+
+	got := make(chan events.Hangup, 1)
+	OnEvent(a, func(e events.Hangup) { got <- e })
+
+	a.dispatch(Message{
+		"Event":       "Hangup",
+		"Channel":     "SIP/100-00000001",
+		"Uniqueid":    "1234.5",
+		"CallerIDNum": "100",
+		"Cause":       "16",
+		"Cause-txt":   "Normal Clearing",
+	})
+
+	select {
+	case e := <-got:
+		if e.Channel != "SIP/100-00000001" || e.Cause != "16" || e.CauseTxt != "Normal Clearing" {
+			t.Fatalf("unmarshalled event = %+v, want matching fields", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnEvent callback was never invoked")
+	}
+}
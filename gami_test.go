@@ -0,0 +1,364 @@
+package gami
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+// fakeTransport is an in-memory Transport double: WritePacket optionally produces a
+// canned response via respond, and ReadPacket blocks until one arrives or downErr
+// fires, at which point it returns that error exactly once (simulating a dropped
+// connection).
+type fakeTransport struct {
+	respond  func(Message) (Message, bool)
+	incoming chan Message
+	downErr  chan error
+}
+
+func newFakeTransport(respond func(Message) (Message, bool)) *fakeTransport {
+	return &fakeTransport{
+		respond:  respond,
+		incoming: make(chan Message, 16),
+		downErr:  make(chan error, 1),
+	}
+}
+
+func (t *fakeTransport) WritePacket(m Message) error {
+	if resp, ok := t.respond(m); ok {
+		t.incoming <- resp
+	}
+	return nil
+}
+
+func (t *fakeTransport) ReadPacket() (Message, error) {
+	select {
+	case err := <-t.downErr:
+		return nil, err
+	case m := <-t.incoming:
+		return m, nil
+	}
+}
+
+func (t *fakeTransport) Close() error { return nil }
+
+// loginOK answers every action, Login included, with a bare success carrying the
+// same ActionID
+func loginOK(m Message) (Message, bool) {
+	return Message{"Response": "Success", "ActionID": m["ActionID"]}, true
+}
+
+// loginOnlyOK answers Login with success and silently drops everything else, so
+// callers relying on it can simulate an action that never gets a response
+func loginOnlyOK(m Message) (Message, bool) {
+	if m["Action"] != "Login" {
+		return nil, false
+	}
+	return Message{"Response": "Success", "ActionID": m["ActionID"]}, true
+}
+
+func TestDoFinishesSpanWithResponseTags(t *testing.T) {
+	tr := mocktracer.New()
+	a := newAsterisk("test", "user", "pass", func() (Transport, error) { return newFakeTransport(loginOK), nil })
+	a.SetTracer(tr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := a.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	resp, err := a.Do(ctx, Message{"Action": "Ping"})
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if resp["Response"] != "Success" {
+		t.Fatalf("resp = %v, want Response=Success", resp)
+	}
+
+	spans := tr.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d finished spans, want 1", len(spans))
+	}
+	if spans[0].OperationName != "ami.action" {
+		t.Errorf("OperationName = %q, want ami.action", spans[0].OperationName)
+	}
+	if spans[0].Tag("Action") != "Ping" {
+		t.Errorf("Action tag = %v, want Ping", spans[0].Tag("Action"))
+	}
+	if spans[0].Tag("Response") != "Success" {
+		t.Errorf("Response tag = %v, want Success", spans[0].Tag("Response"))
+	}
+}
+
+// singleHeaderPropagator packs a MockSpanContext into one "traceID:spanID" string
+// under _TRACE_HEADER, standing in for how a real single-header format (e.g. Jaeger's
+// uber-trace-id) would carry a trace context inbound from Asterisk
+type singleHeaderPropagator struct{}
+
+func (singleHeaderPropagator) Inject(sc mocktracer.MockSpanContext, carrier interface{}) error {
+	writer := carrier.(opentracing.TextMapWriter)
+	writer.Set(_TRACE_HEADER, strconv.Itoa(sc.TraceID)+":"+strconv.Itoa(sc.SpanID))
+	return nil
+}
+
+func (singleHeaderPropagator) Extract(carrier interface{}) (mocktracer.MockSpanContext, error) {
+	reader := carrier.(opentracing.TextMapReader)
+	var encoded string
+	reader.ForeachKey(func(k, v string) error {
+		if k == _TRACE_HEADER {
+			encoded = v
+		}
+		return nil
+	})
+	parts := strings.SplitN(encoded, ":", 2)
+	if len(parts) != 2 {
+		return mocktracer.MockSpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+	traceID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return mocktracer.MockSpanContext{}, err
+	}
+	spanID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return mocktracer.MockSpanContext{}, err
+	}
+	return mocktracer.MockSpanContext{TraceID: traceID, SpanID: spanID, Sampled: true}, nil
+}
+
+func TestStartEventSpanFollowsFromTraceHeader(t *testing.T) {
+	tr := mocktracer.New()
+	tr.RegisterExtractor(opentracing.TextMap, singleHeaderPropagator{})
+	tr.RegisterInjector(opentracing.TextMap, singleHeaderPropagator{})
+
+	a := newAsterisk("test", "user", "pass", nil)
+	a.SetTracer(tr)
+
+	parent := tr.StartSpan("parent").(*mocktracer.MockSpan)
+	carrier := opentracing.TextMapCarrier{}
+	if err := tr.Inject(parent.Context(), opentracing.TextMap, carrier); err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	child := a.startEventSpan("Hangup", Message{_TRACE_HEADER: carrier[_TRACE_HEADER]}).(*mocktracer.MockSpan)
+
+	if child.SpanContext.TraceID != parent.SpanContext.TraceID {
+		t.Errorf("child trace id = %d, want %d (parent's)", child.SpanContext.TraceID, parent.SpanContext.TraceID)
+	}
+	if child.ParentID != parent.SpanContext.SpanID {
+		t.Errorf("child ParentID = %d, want %d (parent's span id)", child.ParentID, parent.SpanContext.SpanID)
+	}
+}
+
+// TestEventSpanChainFollowsOriginateThroughDialAndHangup proves the span chain
+// spans the whole originate -> dial -> hangup lifecycle: the Dial event follows
+// from the Originate action span, and the Hangup event follows from the Dial
+// event's span, all three sharing one trace.
+func TestEventSpanChainFollowsOriginateThroughDialAndHangup(t *testing.T) {
+	tr := mocktracer.New()
+	tr.RegisterExtractor(opentracing.TextMap, singleHeaderPropagator{})
+	tr.RegisterInjector(opentracing.TextMap, singleHeaderPropagator{})
+
+	a := newAsterisk("test", "user", "pass", nil)
+	a.SetTracer(tr)
+
+	originate := a.startActionSpan(Message{"Action": "Originate", "ActionID": "orig-1"})
+	finishActionSpan(originate, Message{"Response": "Success"})
+
+	dialHeader := opentracing.TextMapCarrier{}
+	if err := tr.Inject(originate.Context(), opentracing.TextMap, dialHeader); err != nil {
+		t.Fatalf("Inject (originate): %v", err)
+	}
+	dial := a.startEventSpan("Dial", Message{_TRACE_HEADER: dialHeader[_TRACE_HEADER]}).(*mocktracer.MockSpan)
+	dial.Finish()
+
+	hangupHeader := opentracing.TextMapCarrier{}
+	if err := tr.Inject(dial.Context(), opentracing.TextMap, hangupHeader); err != nil {
+		t.Fatalf("Inject (dial): %v", err)
+	}
+	hangup := a.startEventSpan("Hangup", Message{_TRACE_HEADER: hangupHeader[_TRACE_HEADER]}).(*mocktracer.MockSpan)
+	hangup.Finish()
+
+	originateMock := originate.(*mocktracer.MockSpan)
+	if dial.SpanContext.TraceID != originateMock.SpanContext.TraceID {
+		t.Errorf("dial trace id = %d, want %d (originate's)", dial.SpanContext.TraceID, originateMock.SpanContext.TraceID)
+	}
+	if dial.ParentID != originateMock.SpanContext.SpanID {
+		t.Errorf("dial ParentID = %d, want %d (originate's span id)", dial.ParentID, originateMock.SpanContext.SpanID)
+	}
+	if hangup.SpanContext.TraceID != originateMock.SpanContext.TraceID {
+		t.Errorf("hangup trace id = %d, want %d (originate's)", hangup.SpanContext.TraceID, originateMock.SpanContext.TraceID)
+	}
+	if hangup.ParentID != dial.SpanContext.SpanID {
+		t.Errorf("hangup ParentID = %d, want %d (dial's span id)", hangup.ParentID, dial.SpanContext.SpanID)
+	}
+}
+
+// TestDispatchOpensEventSpanWithoutRegisteredHandler proves dispatch opens (and
+// finishes) an event span for every dispatched event, even when no eventHandlers
+// entry is registered for it.
+func TestDispatchOpensEventSpanWithoutRegisteredHandler(t *testing.T) {
+	tr := mocktracer.New()
+	a := newAsterisk("test", "user", "pass", nil)
+	a.SetTracer(tr)
+
+	a.dispatch(Message{"Event": "Hangup", "Channel": "SIP/100"})
+
+	spans := tr.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d finished spans, want 1", len(spans))
+	}
+	if spans[0].OperationName != "ami.event" {
+		t.Errorf("OperationName = %q, want ami.event", spans[0].OperationName)
+	}
+	if spans[0].Tag("Event") != "Hangup" {
+		t.Errorf("Event tag = %v, want Hangup", spans[0].Tag("Event"))
+	}
+}
+
+func TestCbListExpireFinishesSpanExactlyOnce(t *testing.T) {
+	tr := mocktracer.New()
+	cbl := &cbList{
+		&sync.RWMutex{},
+		make(map[string]*func(Message)),
+		make(map[string]bool),
+		make(map[string]opentracing.Span),
+		make(map[string]time.Time),
+		make(map[string]Message),
+		make(map[string]bool),
+	}
+
+	span := tr.StartSpan("ami.action")
+	f := func(Message) {}
+	cbl.set("k1", &f, false, span, time.Now().Add(-time.Second), Message{"Action": "Ping"}, false)
+
+	cbl.expire(time.Now())
+
+	// a caller racing the janitor (e.g. Do's own ctx.Done() branch) must see that it
+	// lost the race, so it doesn't also finish the span
+	if found := cbl.del("k1"); found {
+		t.Fatalf("del found an entry expire should have already removed")
+	}
+	if spans := tr.FinishedSpans(); len(spans) != 1 {
+		t.Fatalf("got %d finished spans, want exactly 1", len(spans))
+	}
+}
+
+func TestDoContextTimeoutCleansUpPendingCallback(t *testing.T) {
+	a := newAsterisk("test", "user", "pass", func() (Transport, error) { return newFakeTransport(loginOnlyOK), nil })
+	if err := a.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := a.Do(ctx, Message{"Action": "Ping", "ActionID": "timeout-1"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if f, _, _ := a.actionHandlers.get("timeout-1"); f != nil {
+		t.Fatalf("actionHandlers still holds the callback after ctx timed out")
+	}
+}
+
+func TestDoMultiStreamsUntilContextDone(t *testing.T) {
+	a := newAsterisk("test", "user", "pass", func() (Transport, error) { return newFakeTransport(loginOnlyOK), nil })
+	if err := a.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out, err := a.DoMulti(ctx, Message{"Action": "SIPpeers", "ActionID": "multi-1"})
+	if err != nil {
+		t.Fatalf("DoMulti: %v", err)
+	}
+
+	// dispatch runs each matching callback on its own goroutine, so messages aren't
+	// ordered relative to each other; wait for each to land on out before sending
+	// the next one
+	a.dispatch(Message{"ActionID": "multi-1", "Event": "PeerEntry", "Peer": "100"})
+	if m := <-out; m["Peer"] != "100" {
+		t.Fatalf("first message Peer = %q, want 100", m["Peer"])
+	}
+
+	a.dispatch(Message{"ActionID": "multi-1", "Event": "PeerEntry", "Peer": "200"})
+	if m := <-out; m["Peer"] != "200" {
+		t.Fatalf("second message Peer = %q, want 200", m["Peer"])
+	}
+
+	cancel()
+	if _, ok := <-out; ok {
+		t.Fatalf("out should be closed once ctx is done")
+	}
+	if f, _, _ := a.actionHandlers.get("multi-1"); f != nil {
+		t.Fatalf("actionHandlers still holds the callback after DoMulti's ctx was cancelled")
+	}
+}
+
+func TestReconnectReplaysIdempotentPendingAction(t *testing.T) {
+	var mu sync.Mutex
+	var transports []*fakeTransport
+
+	// the first connection never answers the Ping, so it is still pending when that
+	// connection drops; every later connection answers it
+	a := newAsterisk("test", "user", "pass", func() (Transport, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		respond := loginOK
+		if len(transports) == 0 {
+			respond = loginOnlyOK
+		}
+		ft := newFakeTransport(respond)
+		transports = append(transports, ft)
+		return ft, nil
+	})
+	a.SetReconnectPolicy(&ReconnectPolicy{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := a.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if _, err := a.Login(); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	type result struct {
+		resp Message
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := a.Do(ctx, Message{"Action": "Ping", "ActionID": "idemp-1"}, Idempotent())
+		done <- result{resp, err}
+	}()
+
+	// give the goroutine above a moment to register its callback before the
+	// connection drops out from under it
+	time.Sleep(10 * time.Millisecond)
+
+	mu.Lock()
+	first := transports[0]
+	mu.Unlock()
+	first.downErr <- errors.New("connection reset")
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatalf("Do returned %v, want the action to be replayed after reconnect", r.err)
+		}
+		if r.resp["Response"] != "Success" {
+			t.Fatalf("resp = %v, want Response=Success", r.resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the idempotent action to be replayed after reconnect")
+	}
+}
@@ -0,0 +1,321 @@
+package gami
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport, the wire-level carrier for AMI packets; Asterisk dispatches actions and
+// events through one of these instead of touching a socket directly, so the same
+// action code runs unchanged over plain TCP, TLS, or the HTTP(S) mansession interface
+type Transport interface {
+	WritePacket(Message) error
+	ReadPacket() (Message, error)
+	Close() error
+}
+
+// parsePacket, parse the bytes of a single "\r\n\r\n"-terminated AMI packet (as
+// framed by a stream transport) or a single HTTP response body into a Message
+func parsePacket(bp []byte) Message {
+
+	m := make(Message)
+
+	for _, line := range bytes.Split(bp, []byte(_LINE_TERM)) {
+		// empty line
+		if len(line) == 0 {
+			continue
+		}
+		kvl := bytes.SplitN(line, []byte(_KEY_VAL_TERM), 2)
+
+		// not standard header
+		if len(kvl) == 1 {
+			if string(line) != _CMD_END {
+				m["CmdData"] += string(line)
+			}
+			continue
+		}
+
+		k := bytes.TrimSpace(kvl[0])
+		v := bytes.TrimSpace(kvl[1])
+		m[string(k)] = string(v)
+	}
+
+	return m
+}
+
+// splitPackets, split bp on _PT_BYTES and parse each resulting segment as its own
+// packet; a WaitEvent long-poll over HTTP routinely returns several events
+// concatenated in one response body, and feeding that whole body to parsePacket in
+// one call would let the later events' headers overwrite the earlier ones'
+func splitPackets(bp []byte) []Message {
+
+	var msgs []Message
+	for _, seg := range bytes.Split(bp, _PT_BYTES) {
+		if len(bytes.TrimSpace(seg)) == 0 {
+			continue
+		}
+		msgs = append(msgs, parsePacket(seg))
+	}
+
+	return msgs
+}
+
+// streamTransport, a Transport over any framed byte stream (raw TCP or TLS); packets
+// are separated by _PT_BYTES exactly like the original socket-based reader was
+type streamTransport struct {
+	conn net.Conn
+	pbuf *bytes.Buffer
+	buf  []byte
+}
+
+func newStreamTransport(conn net.Conn) *streamTransport {
+	return &streamTransport{
+		conn: conn,
+		pbuf: bytes.NewBufferString(""),
+		buf:  make([]byte, _READ_BUF),
+	}
+}
+
+// newTCPTransport, dial address over plain TCP (the "ami://" scheme)
+func newTCPTransport(address string) (Transport, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamTransport(conn), nil
+}
+
+// newTLSTransport, dial address over TLS (the "amis://" scheme)
+func newTLSTransport(address string, cfg *tls.Config) (Transport, error) {
+	conn, err := tls.Dial("tcp", address, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamTransport(conn), nil
+}
+
+// WritePacket, encode m in AMI wire format and write it whole
+func (t *streamTransport) WritePacket(m Message) error {
+
+	buf := bytes.NewBufferString("")
+
+	for k, v := range m {
+		buf.Write([]byte(k))
+		buf.Write([]byte(_KEY_VAL_TERM))
+		buf.Write([]byte(v))
+		buf.Write([]byte(_LINE_TERM))
+	}
+	buf.Write([]byte(_LINE_TERM))
+
+	if wrb, err := t.conn.Write(buf.Bytes()); wrb != buf.Len() || err != nil {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Not fully writed packet to output stream\n")
+	}
+
+	return nil
+}
+
+// ReadPacket, read off the stream until a full packet is buffered and return it,
+// carrying any trailing partial packet over to the next call
+func (t *streamTransport) ReadPacket() (Message, error) {
+
+	for {
+		if pos := bytes.Index(t.pbuf.Bytes(), _PT_BYTES); pos != -1 {
+			bp := make([]byte, pos+len(_PT_BYTES))
+			if _, err := t.pbuf.Read(bp); err != nil {
+				return nil, err
+			}
+			return parsePacket(bp), nil
+		}
+
+		rc, err := t.conn.Read(t.buf)
+		if err != nil { // network error
+			return nil, err
+		}
+		if _, err := t.pbuf.Write(t.buf[:rc]); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *streamTransport) Close() error {
+	return t.conn.Close()
+}
+
+// httpTransport, a Transport over the Asterisk Manager HTTP(S) "mansession"
+// interface: actions are POSTed to /rawman carrying the mansession_id cookie once
+// the server hands one out, and a background long-poll loop keeps issuing WaitEvent
+// actions so asynchronous events surface on ReadPacket just like they would over a
+// socket transport
+const (
+	_POLL_BACKOFF_BASE = 500 * time.Millisecond // backoff before the first retried WaitEvent poll
+	_POLL_BACKOFF_MAX  = 30 * time.Second       // backoff cap
+)
+
+type httpTransport struct {
+	base   *url.URL
+	client *http.Client
+
+	mu        sync.Mutex
+	sessionID string
+
+	incoming chan Message
+	closeCh  chan struct{}
+	pollOnce sync.Once // pollEvents starts after the first WritePacket (i.e. Login), not on transport creation
+}
+
+// newHTTPTransport, dial rawURL (scheme "http" or "https"; the scheme only picks
+// plain vs TLS, every request goes to /rawman). The WaitEvent long-poll loop isn't
+// started here: it waits for the first WritePacket, so it doesn't fire
+// unauthenticated requests ahead of Login
+func newHTTPTransport(rawURL string) (Transport, error) {
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/rawman"
+
+	t := &httpTransport{
+		base:     u,
+		client:   &http.Client{},
+		incoming: make(chan Message, 16),
+		closeCh:  make(chan struct{}),
+	}
+
+	return t, nil
+}
+
+// WritePacket, POST m to the mansession interface and enqueue every packet its
+// response contains, so ReadPacket can match the first back to the waiting
+// ActionID; a response can carry more than one packet (e.g. a WaitEvent answered
+// while other events are already queued server-side), so all of them are forwarded
+func (t *httpTransport) WritePacket(m Message) error {
+
+	msgs, err := t.do(m)
+	if err != nil {
+		return err
+	}
+
+	t.pollOnce.Do(func() { go t.pollEvents() })
+
+	for _, resp := range msgs {
+		select {
+		case t.incoming <- resp:
+		case <-t.closeCh:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// ReadPacket, return the next action response or polled event
+func (t *httpTransport) ReadPacket() (Message, error) {
+	select {
+	case m, ok := <-t.incoming:
+		if !ok {
+			return nil, fmt.Errorf("gami: http transport closed")
+		}
+		return m, nil
+	case <-t.closeCh:
+		return nil, fmt.Errorf("gami: http transport closed")
+	}
+}
+
+func (t *httpTransport) Close() error {
+	close(t.closeCh)
+	return nil
+}
+
+// pollEvents, long-poll WaitEvent in a loop and forward whatever comes back; this is
+// how asynchronous Events reach ReadPacket over HTTP, since each action response is
+// otherwise only ever delivered to the request that sent it. A failed poll backs off
+// exponentially (capped at _POLL_BACKOFF_MAX) instead of spinning the endpoint; the
+// backoff resets once a poll succeeds again.
+func (t *httpTransport) pollEvents() {
+	backoff := _POLL_BACKOFF_BASE
+	for {
+		select {
+		case <-t.closeCh:
+			return
+		default:
+		}
+
+		msgs, err := t.do(Message{"Action": "WaitEvent"})
+		if err != nil {
+			select {
+			case <-time.After(backoff):
+			case <-t.closeCh:
+				return
+			}
+			if backoff *= 2; backoff > _POLL_BACKOFF_MAX {
+				backoff = _POLL_BACKOFF_MAX
+			}
+			continue
+		}
+		backoff = _POLL_BACKOFF_BASE
+
+		for _, m := range msgs {
+			select {
+			case t.incoming <- m:
+			case <-t.closeCh:
+				return
+			}
+		}
+	}
+}
+
+// do, issue one request/response round trip for m and parse every packet the
+// response body contains
+func (t *httpTransport) do(m Message) ([]Message, error) {
+
+	form := url.Values{}
+	for k, v := range m {
+		form.Set(k, v)
+	}
+
+	req, err := http.NewRequest("POST", t.base.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if sessionID != "" {
+		req.AddCookie(&http.Cookie{Name: "mansession_id", Value: sessionID})
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	for _, c := range resp.Cookies() {
+		if c.Name == "mansession_id" {
+			t.mu.Lock()
+			t.sessionID = c.Value
+			t.mu.Unlock()
+		}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return splitPackets(body), nil
+}
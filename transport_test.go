@@ -0,0 +1,132 @@
+package gami
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestStreamTransportReadPacketFramesOverRealConn exercises streamTransport against
+// an actual loopback net.Conn (rather than fakeTransport), proving ReadPacket
+// recovers one packet at a time from a stream that delivers a full packet followed
+// by a packet split across two writes.
+func TestStreamTransportReadPacketFramesOverRealConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("Response: Success\r\nActionID: 1\r\n\r\n"))
+		conn.Write([]byte("Event: Hangup\r\n"))
+		conn.Write([]byte("Channel: SIP/100\r\n\r\n"))
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	tr := newStreamTransport(conn)
+
+	m1, err := tr.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	if m1["Response"] != "Success" || m1["ActionID"] != "1" {
+		t.Fatalf("m1 = %v, want Response=Success ActionID=1", m1)
+	}
+
+	m2, err := tr.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	if m2["Event"] != "Hangup" || m2["Channel"] != "SIP/100" {
+		t.Fatalf("m2 = %v, want Event=Hangup Channel=SIP/100", m2)
+	}
+
+	<-serverDone
+}
+
+// TestHTTPTransportPollsCookieAndMultipleEvents drives httpTransport against an
+// httptest.Server standing in for the mansession interface: the first request
+// carries no cookie and the server hands one out, the second (WaitEvent) request
+// must carry it back, and a single WaitEvent response concatenating two events must
+// surface as two separate Messages rather than one with overwritten headers.
+func TestHTTPTransportPollsCookieAndMultipleEvents(t *testing.T) {
+	var gotCookie = make(chan string, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.Form.Get("Action") {
+		case "Login":
+			http.SetCookie(w, &http.Cookie{Name: "mansession_id", Value: "sess-1"})
+			w.Write([]byte("Response: Success\r\nActionID: " + r.Form.Get("ActionID") + "\r\n\r\n"))
+		case "WaitEvent":
+			if c, err := r.Cookie("mansession_id"); err == nil {
+				gotCookie <- c.Value
+			} else {
+				gotCookie <- ""
+			}
+			w.Write([]byte("Event: Dial\r\nChannel: SIP/100\r\n\r\nEvent: Hangup\r\nChannel: SIP/200\r\n\r\n"))
+		default:
+			w.Write([]byte("Response: Success\r\n\r\n"))
+		}
+	}))
+	defer srv.Close()
+
+	tr, err := newHTTPTransport(srv.URL)
+	if err != nil {
+		t.Fatalf("newHTTPTransport: %v", err)
+	}
+	defer tr.Close()
+
+	if err := tr.WritePacket(Message{"Action": "Login", "ActionID": "1"}); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+
+	resp, err := tr.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket (login response): %v", err)
+	}
+	if resp["Response"] != "Success" || resp["ActionID"] != "1" {
+		t.Fatalf("resp = %v, want Response=Success ActionID=1", resp)
+	}
+
+	select {
+	case c := <-gotCookie:
+		if c != "sess-1" {
+			t.Fatalf("WaitEvent carried cookie %q, want sess-1", c)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the polled WaitEvent request")
+	}
+
+	first, err := tr.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket (event 1): %v", err)
+	}
+	if first["Event"] != "Dial" || first["Channel"] != "SIP/100" {
+		t.Fatalf("first event = %v, want Event=Dial Channel=SIP/100", first)
+	}
+
+	second, err := tr.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket (event 2): %v", err)
+	}
+	if second["Event"] != "Hangup" || second["Channel"] != "SIP/200" {
+		t.Fatalf("second event = %v, want Event=Hangup Channel=SIP/200", second)
+	}
+}